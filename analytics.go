@@ -0,0 +1,235 @@
+package iotracer
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+// This file adds duty-cycle style analytics over a single traced
+// signal, borrowing the mutator-utilization idea from Go's runtime
+// trace tooling: report how much of the time a signal was asserted,
+// not just across the whole capture but across every sliding window
+// of a chosen length, so e.g. a PWM duty target or a bus-idle
+// guarantee can be checked against worst-case as well as average
+// behavior.
+
+// onSeg marks the start of a constant-value run of a signal; the run
+// extends until the next onSeg's start, or to the end of the trace
+// for the last one.
+type onSeg struct {
+	start time.Time
+	on    bool
+}
+
+// ErrWindowTooLarge is returned by Utilization when the requested
+// window is longer than the recorded trace span.
+var ErrWindowTooLarge = errors.New("utilization window longer than recorded trace span")
+
+// ErrInvalidWindow is returned by Utilization when the requested
+// window is zero or negative.
+var ErrInvalidWindow = errors.New("utilization window must be positive")
+
+// signalSegments snapshots the trace and projects it down to the
+// on/off runs of a single signal bit, ignoring samples whose mask
+// does not cover that bit (the signal's value didn't change, or
+// was never known, at that sample). The returned end is the When of
+// the trace's last recorded sample overall, not necessarily a sample
+// that touched sig — it marks how long the final segment's value is
+// known to have held, even across a trailing stretch with no further
+// transitions of sig itself.
+func (t *Trace) signalSegments(sig int) (segs []onSeg, end time.Time, err error) {
+	if t == nil || sig < 0 || sig >= 64 {
+		return nil, time.Time{}, ErrInvalidSignalIndex
+	}
+	bit := uint64(1) << uint(sig)
+
+	t.mu.Lock()
+	cursor := t.cursor
+	samples := cursor
+	if samples > t.maxSamples {
+		samples = t.maxSamples
+	}
+	start := (cursor + t.maxSamples - samples) % t.maxSamples
+	working := make([]Sample, samples)
+	if samples != cursor {
+		copy(working[:samples-start], t.samples[start:])
+		copy(working[samples-start:], t.samples[:start])
+	} else {
+		copy(working[:samples], t.samples[:samples])
+	}
+	t.mu.Unlock()
+
+	haveLast, lastOn := false, false
+	for _, s := range working {
+		if s.Mask&bit != 0 {
+			on := s.Value&bit != 0
+			if !haveLast || on != lastOn {
+				segs = append(segs, onSeg{start: s.When, on: on})
+				haveLast, lastOn = true, on
+			}
+		}
+	}
+	if len(segs) < 2 {
+		return nil, time.Time{}, ErrNoTraceData
+	}
+	return segs, working[len(working)-1].When, nil
+}
+
+// cumulativeOnTime returns, for each index i, the total on-time of
+// segs[:i] — i.e. prefix[i] is the integral of the on/off step
+// function from segs[0].start up to (but not including) segs[i].start.
+// prefix[len(segs)] is the total on-time over the whole span, with the
+// final segment's run extending to end rather than stopping at its
+// own start.
+func cumulativeOnTime(segs []onSeg, end time.Time) []float64 {
+	prefix := make([]float64, len(segs)+1)
+	for i := 0; i < len(segs); i++ {
+		next := end
+		if i+1 < len(segs) {
+			next = segs[i+1].start
+		}
+		d := next.Sub(segs[i].start).Seconds()
+		if segs[i].on {
+			prefix[i+1] = prefix[i] + d
+		} else {
+			prefix[i+1] = prefix[i]
+		}
+	}
+	return prefix
+}
+
+// cumAt returns the integral of the on/off step function described by
+// segs from segs[0].start up to t, using the precomputed prefix sums.
+// t is clamped to end, since the step function isn't defined past the
+// last known sample.
+func cumAt(segs []onSeg, prefix []float64, end time.Time, t time.Time) float64 {
+	i := sort.Search(len(segs), func(i int) bool { return segs[i].start.After(t) }) - 1
+	if i < 0 {
+		return 0
+	}
+	next := end
+	if i+1 < len(segs) {
+		next = segs[i+1].start
+	}
+	if t.After(next) {
+		t = next
+	}
+	extra := 0.0
+	if segs[i].on {
+		extra = t.Sub(segs[i].start).Seconds()
+	}
+	return prefix[i] + extra
+}
+
+// windowUtilizations returns the fraction of time sig was high across
+// every sliding window of length window, sampled at every critical
+// point (each segment boundary and each boundary offset by -window),
+// which is enough to find the true extrema of a piecewise-linear
+// cumulative on-time function. The span considered runs from the
+// first recorded transition of sig to the trace's last recorded
+// sample overall, so a signal that settles and is never touched again
+// still reports the held value for the remainder of the capture.
+func (t *Trace) windowUtilizations(sig int, window time.Duration) ([]float64, []onSeg, []float64, time.Time, error) {
+	if window <= 0 {
+		return nil, nil, nil, time.Time{}, ErrInvalidWindow
+	}
+	segs, end, err := t.signalSegments(sig)
+	if err != nil {
+		return nil, nil, nil, time.Time{}, err
+	}
+	span := end.Sub(segs[0].start)
+	if window > span {
+		return nil, nil, nil, time.Time{}, ErrWindowTooLarge
+	}
+	prefix := cumulativeOnTime(segs, end)
+
+	first := segs[0].start
+	maxStart := end.Add(-window)
+	clip := func(at time.Time) time.Time {
+		if at.Before(first) {
+			return first
+		}
+		if at.After(maxStart) {
+			return maxStart
+		}
+		return at
+	}
+
+	candidates := []time.Time{first, maxStart}
+	for _, s := range segs {
+		candidates = append(candidates, clip(s.start), clip(s.start.Add(-window)))
+	}
+
+	ws := window.Seconds()
+	utils := make([]float64, 0, len(candidates))
+	for _, a := range candidates {
+		u := (cumAt(segs, prefix, end, a.Add(window)) - cumAt(segs, prefix, end, a)) / ws
+		utils = append(utils, u)
+	}
+	return utils, segs, prefix, end, nil
+}
+
+// UtilBands reports the minimum, mean and maximum fraction of time a
+// signal was asserted (high), across every sliding window of a chosen
+// length within the trace's recorded span.
+type UtilBands struct {
+	// Min is the lowest utilization seen in any window.
+	Min float64
+	// Mean is the overall on-time fraction across the whole span.
+	Mean float64
+	// Max is the highest utilization seen in any window.
+	Max float64
+}
+
+// Utilization reports the minimum, mean and maximum fraction of time
+// sig was asserted across every sliding window of the given length,
+// over the samples currently held in the trace. window must be
+// positive and no longer than the trace's recorded span.
+func (t *Trace) Utilization(sig int, window time.Duration) (*UtilBands, error) {
+	utils, segs, prefix, end, err := t.windowUtilizations(sig, window)
+	if err != nil {
+		return nil, err
+	}
+	span := end.Sub(segs[0].start)
+	bands := &UtilBands{
+		Mean: prefix[len(prefix)-1] / span.Seconds(),
+	}
+	bands.Min, bands.Max = math.Inf(1), math.Inf(-1)
+	for _, u := range utils {
+		if u < bands.Min {
+			bands.Min = u
+		}
+		if u > bands.Max {
+			bands.Max = u
+		}
+	}
+	return bands, nil
+}
+
+// UtilizationHistogram buckets the per-window utilization values
+// computed by Utilization into buckets equal-width bins over [0,1],
+// returning a count per bin. It is useful for visualizing how tightly
+// a PWM duty cycle, or a bus-idle guarantee, is actually held.
+func (t *Trace) UtilizationHistogram(sig int, window time.Duration, buckets int) ([]uint, error) {
+	if buckets <= 0 {
+		return nil, errors.New("utilization histogram bucket count must be positive")
+	}
+	utils, _, _, _, err := t.windowUtilizations(sig, window)
+	if err != nil {
+		return nil, err
+	}
+	hist := make([]uint, buckets)
+	for _, u := range utils {
+		b := int(u * float64(buckets))
+		if b >= buckets {
+			b = buckets - 1
+		}
+		if b < 0 {
+			b = 0
+		}
+		hist[b]++
+	}
+	return hist, nil
+}
@@ -46,9 +46,9 @@ func main() {
 	tr.Cancel(ch)
 	wg.Wait()
 
-	// merge together 3 bits.
-	if err := tr2.Alias(1, 0, 2, "octo"); err != nil {
-		log.Fatalf("unable to alias 3 bits of tr2: %v", err)
+	// group 3 bits into a single readable bus.
+	if err := tr2.Bus("octo", []int{1, 0, 2}, iotracer.BusUnsigned); err != nil {
+		log.Fatalf("unable to declare bus octo on tr2: %v", err)
 	}
 
 	b, err := iotracer.ExportVCD("top", 100*time.Nanosecond, tr, tr2)
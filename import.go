@@ -0,0 +1,385 @@
+package iotracer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file implements ImportVCD, the inverse of ExportVCD/WriteVCD:
+// it parses a VCD dump (produced by this package, or by a
+// GTKWave-family tool) and reconstructs one *Trace per top-level
+// $scope module block, replaying its recorded value changes via
+// SampleAt. This closes the loop so captures can be persisted,
+// shared, and later fed back into analytics such as Utilization, or
+// re-exported, and lets the package double as a general purpose VCD
+// reader.
+
+// ErrMalformedVCD is returned when the input cannot be parsed as a
+// VCD dump.
+var ErrMalformedVCD = errors.New("malformed VCD input")
+
+// ErrTooManySignals is returned when a single $scope module block
+// declares more signal bits than fit in a Trace's 64-bit mask/value
+// pair.
+var ErrTooManySignals = errors.New("VCD module declares more than 64 signal bits")
+
+// impVar records one $var declaration: the bit positions it occupies
+// in its reconstructed Trace (a single entry for a plain wire, or
+// width entries, most significant first, for a bus), plus enough to
+// replay a Bus/EnumBus/Label declaration on the new Trace.
+type impVar struct {
+	bits     []int
+	label    string
+	encoding BusEncoding
+	states   map[uint64]string
+}
+
+// impBlock accumulates everything needed to build one reconstructed
+// Trace: its app/module names, its declared variables (keyed by VCD
+// id), and the running cumulative mask/value carried forward as
+// changes are replayed.
+type impBlock struct {
+	app, module string
+	vars        map[string]*impVar
+	nextBit     int
+	mask, value uint64
+}
+
+// vcdTokens splits a VCD file into whitespace-separated tokens,
+// exactly as produced by the corresponding split on vcdSection's
+// output: every keyword, value-change, and $end marker is its own
+// token.
+func vcdTokens(r io.Reader) ([]string, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	sc.Split(bufio.ScanWords)
+	var toks []string
+	for sc.Scan() {
+		toks = append(toks, sc.Text())
+	}
+	return toks, sc.Err()
+}
+
+// skipToEnd consumes tokens[i:] up to and including the next "$end",
+// returning the joined content in between and the index just past
+// "$end".
+func skipToEnd(tokens []string, i int) (content string, next int, err error) {
+	var words []string
+	for ; i < len(tokens); i++ {
+		if tokens[i] == "$end" {
+			return strings.Join(words, " "), i + 1, nil
+		}
+		words = append(words, tokens[i])
+	}
+	return "", i, ErrMalformedVCD
+}
+
+// parseEnumComment recognizes a "$comment <label> <value> = <name>"
+// line, as written by writeVCDHeader for a BusEnum signal.
+func parseEnumComment(content, label string) (uint64, string, bool) {
+	prefix := label + " "
+	if !strings.HasPrefix(content, prefix) {
+		return 0, "", false
+	}
+	rest := content[len(prefix):]
+	parts := strings.SplitN(rest, " = ", 2)
+	if len(parts) != 2 {
+		return 0, "", false
+	}
+	v, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return v, parts[1], true
+}
+
+// ImportVCD parses a VCD dump from r and reconstructs one *Trace per
+// top-level $scope module block, preserving the second-level scope
+// name via Trace.Module, mapping each wire var back through Label (or
+// Bus/EnumBus for multi-bit vectors), and replaying #<stamp> value
+// changes as SampleAt calls on a trace sized to the number of
+// transitions it actually recorded. An 'x' value leaves the
+// corresponding bit unasserted in the replayed mask, rather than
+// guessing its value.
+func ImportVCD(r io.Reader) ([]*Trace, error) {
+	tokens, err := vcdTokens(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks []*impBlock
+	idOwner := make(map[string]*impBlock)
+	idVar := make(map[string]*impVar)
+	var scopeStack []string
+	var dateStr string
+	var tScale time.Duration = time.Nanosecond
+
+	i := 0
+	for i < len(tokens) {
+		tok := tokens[i]
+		switch tok {
+		case "$date":
+			dateStr, i, err = skipToEnd(tokens, i+1)
+		case "$version":
+			_, i, err = skipToEnd(tokens, i+1)
+		case "$timescale":
+			var content string
+			if content, i, err = skipToEnd(tokens, i+1); err == nil {
+				if d, perr := time.ParseDuration(strings.ReplaceAll(content, " ", "")); perr == nil {
+					tScale = d
+				}
+			}
+		case "$comment":
+			var content string
+			if content, i, err = skipToEnd(tokens, i+1); err == nil && len(blocks) > 0 {
+				b := blocks[len(blocks)-1]
+				for _, v := range b.vars {
+					if strings.HasPrefix(content, v.label+" signed") {
+						v.encoding = BusSigned
+					} else if val, name, ok := parseEnumComment(content, v.label); ok {
+						v.encoding = BusEnum
+						if v.states == nil {
+							v.states = make(map[uint64]string)
+						}
+						v.states[val] = name
+					}
+				}
+			}
+		case "$scope":
+			if i+2 >= len(tokens) {
+				return nil, ErrMalformedVCD
+			}
+			name := tokens[i+2]
+			scopeStack = append(scopeStack, name)
+			if len(scopeStack) == 1 {
+				blocks = append(blocks, &impBlock{app: name, vars: make(map[string]*impVar)})
+			} else if len(scopeStack) == 2 && len(blocks) > 0 {
+				blocks[len(blocks)-1].module = name
+			}
+			_, i, err = skipToEnd(tokens, i+3)
+		case "$upscope":
+			if len(scopeStack) > 0 {
+				scopeStack = scopeStack[:len(scopeStack)-1]
+			}
+			_, i, err = skipToEnd(tokens, i+1)
+		case "$var":
+			if i+4 >= len(tokens) {
+				return nil, ErrMalformedVCD
+			}
+			width, werr := strconv.Atoi(tokens[i+2])
+			if werr != nil {
+				return nil, ErrMalformedVCD
+			}
+			id := tokens[i+3]
+			var label string
+			if label, i, err = skipToEnd(tokens, i+4); err == nil {
+				// The name is the first whitespace-separated word;
+				// any later words (such as a "[7:0]" index suffix)
+				// are dropped.
+				if fields := strings.Fields(label); len(fields) > 0 {
+					label = fields[0]
+				}
+				if len(blocks) == 0 {
+					return nil, ErrMalformedVCD
+				}
+				b := blocks[len(blocks)-1]
+				if b.nextBit+width > 64 {
+					return nil, fmt.Errorf("%w: module %q declares more than 64 signal bits", ErrTooManySignals, b.app)
+				}
+				v := &impVar{label: label}
+				for k := 0; k < width; k++ {
+					v.bits = append(v.bits, b.nextBit)
+					b.nextBit++
+				}
+				b.vars[id] = v
+				idOwner[id] = b
+				idVar[id] = v
+			}
+		case "$enddefinitions":
+			_, i, err = skipToEnd(tokens, i+1)
+			if err == nil {
+				goto body
+			}
+		default:
+			i++
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+body:
+	if len(blocks) == 0 {
+		return nil, ErrNoTraceData
+	}
+
+	base := time.Time{}
+	if dateStr != "" {
+		if t, perr := time.Parse(time.ANSIC, dateStr); perr == nil {
+			base = t
+		}
+	}
+
+	counts, err := countVCDTransitions(tokens[i:], idOwner, blocks)
+	if err != nil {
+		return nil, err
+	}
+
+	traces := make([]*Trace, len(blocks))
+	for bi, b := range blocks {
+		n := counts[b]
+		if n == 0 {
+			n = 1
+		}
+		tr := NewTrace(b.app, uint(n))
+		tr.Module(b.module)
+		for _, v := range b.vars {
+			var verr error
+			switch {
+			case len(v.bits) == 1:
+				verr = tr.Label(v.bits[0], v.label)
+			case v.encoding == BusEnum:
+				verr = tr.EnumBus(v.label, v.bits, v.states)
+			default:
+				verr = tr.Bus(v.label, v.bits, v.encoding)
+			}
+			if verr != nil {
+				return nil, fmt.Errorf("replaying $var %q in module %q: %w", v.label, b.app, verr)
+			}
+		}
+		traces[bi] = tr
+		b.mask, b.value = 0, 0
+	}
+
+	var stamp uint64
+	changed := make(map[*impBlock]bool)
+	flush := func() {
+		for bi, b := range blocks {
+			if changed[b] {
+				traces[bi].SampleAt(base.Add(time.Duration(stamp)*tScale), b.mask, b.value)
+			}
+		}
+		changed = make(map[*impBlock]bool)
+	}
+
+	for j := i; j < len(tokens); j++ {
+		tok := tokens[j]
+		switch {
+		case tok == "$dumpvars" || tok == "$end":
+			continue
+		case strings.HasPrefix(tok, "#"):
+			flush()
+			n, perr := strconv.ParseUint(tok[1:], 10, 64)
+			if perr != nil {
+				return nil, ErrMalformedVCD
+			}
+			stamp = n
+		case strings.HasPrefix(tok, "b"):
+			if j+1 >= len(tokens) {
+				return nil, ErrMalformedVCD
+			}
+			bits := tok[1:]
+			id := tokens[j+1]
+			j++
+			v, ok := idVar[id]
+			b := idOwner[id]
+			if !ok || b == nil {
+				continue
+			}
+			applyBusValue(b, v, bits)
+			changed[b] = true
+		default:
+			if len(tok) < 2 {
+				continue
+			}
+			id := tok[1:]
+			v, ok := idVar[id]
+			b := idOwner[id]
+			if !ok || b == nil {
+				continue
+			}
+			applyBitValue(b, v.bits[0], tok[0])
+			changed[b] = true
+		}
+	}
+	flush()
+
+	return traces, nil
+}
+
+// applyBitValue updates a block's cumulative mask/value for a
+// single-bit change: '1' sets it, '0' clears it (while asserting the
+// bit is known), and anything else (VCD's 'x') leaves it unasserted.
+func applyBitValue(b *impBlock, idx int, c byte) {
+	bit := uint64(1) << uint(idx)
+	switch c {
+	case '1':
+		b.mask |= bit
+		b.value |= bit
+	case '0':
+		b.mask |= bit
+		b.value &^= bit
+	default:
+		b.mask &^= bit
+		b.value &^= bit
+	}
+}
+
+// applyBusValue updates a block's cumulative mask/value for a bus
+// change, applying each character of bits (most significant first)
+// to its corresponding bit position in v.bits.
+func applyBusValue(b *impBlock, v *impVar, bits string) {
+	if len(bits) != len(v.bits) {
+		return
+	}
+	for i, c := range []byte(bits) {
+		applyBitValue(b, v.bits[i], c)
+	}
+}
+
+// countVCDTransitions counts, per block, how many distinct
+// timestamps recorded at least one value change for that block's
+// variables, so each reconstructed Trace's circular buffer can be
+// sized to fit its whole replay without wrapping.
+func countVCDTransitions(body []string, idOwner map[string]*impBlock, blocks []*impBlock) (map[*impBlock]int, error) {
+	counts := make(map[*impBlock]int, len(blocks))
+	changed := make(map[*impBlock]bool)
+	flush := func() {
+		for b := range changed {
+			counts[b]++
+		}
+		changed = make(map[*impBlock]bool)
+	}
+	for j := 0; j < len(body); j++ {
+		tok := body[j]
+		switch {
+		case tok == "$dumpvars" || tok == "$end":
+			continue
+		case strings.HasPrefix(tok, "#"):
+			flush()
+		case strings.HasPrefix(tok, "b"):
+			if j+1 >= len(body) {
+				return nil, ErrMalformedVCD
+			}
+			id := body[j+1]
+			j++
+			if b := idOwner[id]; b != nil {
+				changed[b] = true
+			}
+		default:
+			if len(tok) < 2 {
+				continue
+			}
+			if b := idOwner[tok[1:]]; b != nil {
+				changed[b] = true
+			}
+		}
+	}
+	flush()
+	return counts, nil
+}
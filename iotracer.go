@@ -3,11 +3,13 @@
 package iotracer
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -30,6 +32,36 @@ type Event struct {
 	On bool
 }
 
+// BusEncoding selects how a Bus's value is interpreted when it is
+// rendered, so tools like GTKWave can display something more useful
+// than a raw bit pattern.
+type BusEncoding int
+
+const (
+	// BusUnsigned renders the bus as an unsigned binary value.
+	BusUnsigned BusEncoding = iota
+	// BusSigned renders the bus as a two's-complement signed value.
+	BusSigned
+	// BusEnum renders the bus as a named state, using a caller
+	// supplied map[uint64]string of state names.
+	BusEnum
+)
+
+// vecBus records a named group of bit positions that are traced
+// together as a single multi-bit VCD signal, in place of N loose
+// single-bit wires.
+type vecBus struct {
+	// name is the VCD label for the bus.
+	name string
+	// bits lists the constituent signal indices, most significant
+	// bit first.
+	bits []int
+	// encoding controls how values are annotated in the VCD dump.
+	encoding BusEncoding
+	// states names enum values, only used when encoding is BusEnum.
+	states map[uint64]string
+}
+
 // Trace holds a tracer.
 type Trace struct {
 	// app names the subsystem that is making the trace.
@@ -62,6 +94,10 @@ type Trace struct {
 	// index of the traced bit value.
 	labels map[int]string
 
+	// buses holds the declared multi-bit vector signals, in the
+	// order they were added.
+	buses []vecBus
+
 	// changes hold channels to write to when tracked IO values
 	// change.
 	changes map[uint64][]chan Event
@@ -95,6 +131,71 @@ func (t *Trace) Module(name string) {
 	t.module = name
 }
 
+// App returns the trace's app name, as set by NewTrace.
+func (t *Trace) App() string {
+	if t == nil {
+		return ""
+	}
+	return t.app
+}
+
+// ModuleName returns the trace's current module name, defaulting to
+// "ports" exactly as VCD output does.
+func (t *Trace) ModuleName() string {
+	if t == nil || t.module == "" {
+		return "ports"
+	}
+	return t.module
+}
+
+// SignalInfo describes one traced bit position and its label.
+type SignalInfo struct {
+	Index int
+	Label string
+}
+
+// Signals returns the bit positions seen by the trace so far, along
+// with their current labels. A declared Bus or EnumBus reports once,
+// under its bus name and the index of its first (most significant)
+// bit, in place of its constituent bit positions; buses come first,
+// in declaration order, followed by the remaining bits in index
+// order, matching the grouping cacheVCDDetail uses for VCD export.
+func (t *Trace) Signals() []SignalInfo {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []SignalInfo
+	var busBits uint64
+	for _, bus := range t.buses {
+		for _, b := range bus.bits {
+			busBits |= uint64(1) << uint(b)
+		}
+		out = append(out, SignalInfo{Index: bus.bits[0], Label: bus.name})
+	}
+	for i, bit := 0, uint64(1); bit != 0 && bit <= t.fullMask; i, bit = i+1, bit<<1 {
+		if t.fullMask&bit == 0 || busBits&bit != 0 {
+			continue
+		}
+		lab := t.labels[i]
+		if lab == "" {
+			lab = fmt.Sprintf("sig%d", i)
+		}
+		out = append(out, SignalInfo{Index: i, Label: lab})
+	}
+	return out
+}
+
+// Snapshot returns a thread safe copy of the samples currently held
+// in the trace's circular buffer, in chronological order.
+func (t *Trace) Snapshot() []Sample {
+	if t == nil {
+		return nil
+	}
+	return t.snapshotSince(time.Time{})
+}
+
 // ErrInvalidSignalIndex is returned if an attempt is made to
 // reference an impossible signal bit.
 var ErrInvalidSignalIndex = errors.New("invalid signal index, want [0,64)")
@@ -113,6 +214,52 @@ func (t *Trace) Label(sig int, label string) error {
 	return nil
 }
 
+// ErrInvalidBus is returned if a bus declaration names no bits, too
+// many bits, or an out of range bit.
+var ErrInvalidBus = errors.New("invalid bus: want a name and [1,64] distinct bits in [0,64)")
+
+// Bus declares an ordered group of bit positions, most significant
+// bit first, as a single multi-bit VCD signal named name. This
+// replaces the individual sig<n> wires those bits would otherwise
+// generate, so buses like address lines, state-machine states or
+// counters show up as one readable value instead of N loose wires.
+func (t *Trace) Bus(name string, bits []int, encoding BusEncoding) error {
+	return t.addBus(name, bits, encoding, nil)
+}
+
+// EnumBus declares a bus, as per Bus, whose values are named by
+// states. The mapping is recorded as VCD $comment metadata so tools
+// that ignore comments still see the raw bit pattern.
+func (t *Trace) EnumBus(name string, bits []int, states map[uint64]string) error {
+	return t.addBus(name, bits, BusEnum, states)
+}
+
+// addBus validates and records a vecBus declaration.
+func (t *Trace) addBus(name string, bits []int, encoding BusEncoding, states map[uint64]string) error {
+	if t == nil || name == "" || len(bits) == 0 || len(bits) > 64 {
+		return ErrInvalidBus
+	}
+	seen := make(map[int]bool, len(bits))
+	for _, b := range bits {
+		if b < 0 || b >= 64 {
+			return ErrInvalidBus
+		}
+		if seen[b] {
+			return ErrInvalidBus
+		}
+		seen[b] = true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buses = append(t.buses, vecBus{
+		name:     name,
+		bits:     append([]int(nil), bits...),
+		encoding: encoding,
+		states:   states,
+	})
+	return nil
+}
+
 // Watch opens an Event channel to watch for changes in value of a
 // specified signal.
 func (t *Trace) Watch(sig, depth int) (<-chan Event, error) {
@@ -196,24 +343,39 @@ func (t *Trace) Sample(mask, value uint64) {
 }
 
 // Output a section named such containing content with an end.
-func vcdSection(ch chan<- string, section, content string, oneLine bool) {
+func vcdSection(emit func(string), section, content string, oneLine bool) {
 	if oneLine {
-		ch <- fmt.Sprintf("$%s %s $end", section, content)
+		emit(fmt.Sprintf("$%s %s $end", section, content))
 	} else {
-		ch <- fmt.Sprint("$", section)
-		ch <- fmt.Sprint("\t", content)
-		ch <- "$end"
+		emit(fmt.Sprint("$", section))
+		emit(fmt.Sprint("\t", content))
+		emit("$end")
 	}
 }
 
 // ErrNoTraceData indicates the current trace contains no data.
 var ErrNoTraceData = errors.New("no trace data")
 
-// signal is used for VCD signal identification.
+// signal is used for VCD signal identification. A single-bit signal
+// only uses mask; a bus signal leaves mask zero and instead lists its
+// constituent bit positions, most significant first.
 type signal struct {
-	mask uint64
-	ch   string
-	lab  string
+	mask     uint64
+	bits     []int
+	ch       string
+	lab      string
+	encoding BusEncoding
+	states   map[uint64]string
+}
+
+// busMask returns the union of the bit positions making up a bus
+// signal, or 0 for a single-bit signal.
+func (s signal) busMask() uint64 {
+	var m uint64
+	for _, b := range s.bits {
+		m |= uint64(1) << uint(b)
+	}
+	return m
 }
 
 // keyOf represents the number j in a unique VCD preferred format.
@@ -229,9 +391,29 @@ func keyOf(j int) string {
 	return strings.Join(cs, "")
 }
 
+// busValue renders a bus's constituent bits, most significant first,
+// as a VCD b-format binary string. A constituent bit not present in
+// mask is rendered as 'x' (unknown).
+func busValue(bits []int, mask, value uint64) string {
+	out := make([]byte, len(bits))
+	for i, b := range bits {
+		m := uint64(1) << uint(b)
+		switch {
+		case mask&m == 0:
+			out[i] = 'x'
+		case value&m != 0:
+			out[i] = '1'
+		default:
+			out[i] = '0'
+		}
+	}
+	return string(out)
+}
+
 // VCDDetail holds everything needed to produce a VCD dump for a
 // single trace.
 type VCDDetail struct {
+	owner    *Trace
 	app      string
 	module   string
 	fullMask uint64
@@ -259,6 +441,7 @@ func (t *Trace) cacheVCDDetail(index int) (*VCDDetail, int) {
 		samples = t.maxSamples
 	}
 	v := &VCDDetail{
+		owner:    t,
 		module:   module,
 		fullMask: t.fullMask,
 		app:      t.app,
@@ -272,9 +455,25 @@ func (t *Trace) cacheVCDDetail(index int) (*VCDDetail, int) {
 	} else {
 		copy(v.working[:samples], t.samples[:samples])
 	}
+	var busBits uint64
+	for _, bus := range t.buses {
+		sig := signal{
+			bits:     append([]int(nil), bus.bits...),
+			ch:       keyOf(index),
+			lab:      bus.name,
+			encoding: bus.encoding,
+			states:   bus.states,
+		}
+		index++
+		for _, b := range bus.bits {
+			busBits |= uint64(1) << uint(b)
+		}
+		v.sigs = append(v.sigs, sig)
+	}
+
 	j := index
-	for i, bit := 0, uint64(1); bit != 0 && bit < v.fullMask; i, bit = i+1, bit<<1 {
-		if v.fullMask&bit != 0 {
+	for i, bit := 0, uint64(1); bit != 0 && bit <= v.fullMask; i, bit = i+1, bit<<1 {
+		if v.fullMask&bit != 0 && busBits&bit == 0 {
 			lab := t.labels[i]
 			if lab == "" {
 				lab = fmt.Sprintf("sig%d", i)
@@ -291,14 +490,44 @@ func (t *Trace) cacheVCDDetail(index int) (*VCDDetail, int) {
 	return v, j
 }
 
+// snapshotSince returns a thread safe copy of the samples recorded
+// strictly after since, in chronological order. It is used by
+// VCDEncoder to pick up where a previous Flush left off, without
+// re-walking samples already written out.
+func (t *Trace) snapshotSince(since time.Time) []Sample {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cursor := t.cursor
+	samples := cursor
+	if samples > t.maxSamples {
+		samples = t.maxSamples
+	}
+	start := (cursor + t.maxSamples - samples) % t.maxSamples
+
+	out := make([]Sample, 0, samples)
+	for i := uint(0); i < samples; i++ {
+		s := t.samples[(start+i)%t.maxSamples]
+		if s.When.After(since) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
 // Datum is used to manage the construction of a VCD signal trace dump.
 type Datum struct {
 	stamp uint
 	line  string
 }
 
+// vcdMergeBufSize bounds each subchannel in the mergeVCD merge tree,
+// so a slow consumer (e.g. a disk-backed sink) doesn't force every
+// producer goroutine in the tree to block in lockstep.
+const vcdMergeBufSize = 64
+
 func mergeVCD(earliest time.Time, tScale time.Duration, details []*VCDDetail) <-chan Datum {
-	ch := make(chan Datum)
+	ch := make(chan Datum, vcdMergeBufSize)
 	go func() {
 		defer close(ch)
 		k := len(details)
@@ -316,6 +545,16 @@ func mergeVCD(earliest time.Time, tScale time.Duration, details []*VCDDetail) <-
 					// Something has changed, so we need to include it in the dump file.
 					stamp := uint(s.When.Sub(earliest) / tScale)
 					for _, sig := range v.sigs {
+						if len(sig.bits) != 0 {
+							busMask := sig.busMask()
+							if i == 0 || busMask&anyDelta != 0 {
+								ch <- Datum{
+									stamp: stamp,
+									line:  fmt.Sprintf("b%s %s", busValue(sig.bits, s.Mask, s.Value), sig.ch),
+								}
+							}
+							continue
+						}
 						if sig.mask&s.Mask == 0 {
 							if i == 0 || sig.mask&dMask != 0 {
 								ch <- Datum{
@@ -380,11 +619,28 @@ func mergeVCD(earliest time.Time, tScale time.Duration, details []*VCDDetail) <-
 	return ch
 }
 
-// ExportVCD generates a single VCD dump file from a set of concurrent
-// trace recordings. The argument dumper names the collection of
-// traces and tScale indicates what a count of 1 means in the counter
-// output.
-func ExportVCD(dumper string, tScale time.Duration, traces ...*Trace) (<-chan string, error) {
+// namedState pairs a bus value with its enum state name.
+type namedState struct {
+	value uint64
+	name  string
+}
+
+// stateNames returns the entries of an enum bus's state map sorted by
+// value, so $comment output is deterministic.
+func stateNames(states map[uint64]string) []namedState {
+	out := make([]namedState, 0, len(states))
+	for v, name := range states {
+		out = append(out, namedState{value: v, name: name})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].value < out[j].value })
+	return out
+}
+
+// buildVCDDetails snapshots the given traces into VCDDetail values
+// ready for rendering, assigning each recorded signal and bus a
+// unique VCD identifier. It returns the earliest sample time across
+// all the traces, which anchors every subsequent timestamp.
+func buildVCDDetails(traces []*Trace) ([]*VCDDetail, time.Time, error) {
 	var details []*VCDDetail
 	j := 0
 	var earliest time.Time
@@ -401,45 +657,218 @@ func ExportVCD(dumper string, tScale time.Duration, traces ...*Trace) (<-chan st
 		j = k
 	}
 	if j == 0 {
-		return nil, ErrNoTraceData
+		return nil, time.Time{}, ErrNoTraceData
 	}
-	ch := make(chan string)
-	go func() {
-		defer close(ch)
-
-		vcdSection(ch, "date", earliest.Format(time.ANSIC), false)
-		vcdSection(ch, "version", dumper, false)
-		vcdSection(ch, "timescale", fmt.Sprintf("%v", tScale), false)
+	return details, earliest, nil
+}
 
-		for _, v := range details {
-			vcdSection(ch, "scope", fmt.Sprintf("module %s", v.app), true)
-			vcdSection(ch, "scope", fmt.Sprintf("module %s", v.module), true)
-			for _, sig := range v.sigs {
-				vcdSection(ch, "var", fmt.Sprintf("wire 1 %s %s", sig.ch, sig.lab), true)
+// writeVCDHeader emits the date/version/timescale preamble plus the
+// scope/var declarations and the closing $enddefinitions for details.
+func writeVCDHeader(emit func(string), dumper string, tScale time.Duration, earliest time.Time, details []*VCDDetail) {
+	vcdSection(emit, "date", earliest.Format(time.ANSIC), false)
+	vcdSection(emit, "version", dumper, false)
+	vcdSection(emit, "timescale", fmt.Sprintf("%v", tScale), false)
+
+	for _, v := range details {
+		vcdSection(emit, "scope", fmt.Sprintf("module %s", v.app), true)
+		vcdSection(emit, "scope", fmt.Sprintf("module %s", v.module), true)
+		for _, sig := range v.sigs {
+			if len(sig.bits) == 0 {
+				vcdSection(emit, "var", fmt.Sprintf("wire 1 %s %s", sig.ch, sig.lab), true)
+				continue
+			}
+			vcdSection(emit, "var", fmt.Sprintf("wire %d %s %s", len(sig.bits), sig.ch, sig.lab), true)
+			switch sig.encoding {
+			case BusSigned:
+				vcdSection(emit, "comment", fmt.Sprintf("%s signed two's-complement", sig.lab), true)
+			case BusEnum:
+				for _, state := range stateNames(sig.states) {
+					vcdSection(emit, "comment", fmt.Sprintf("%s %d = %s", sig.lab, state.value, state.name), true)
+				}
 			}
-			ch <- "$upscope $end"
-			ch <- "$upscope $end"
 		}
+		emit("$upscope $end")
+		emit("$upscope $end")
+	}
 
-		ch <- "$enddefinitions $end"
-
-		var stamp uint
-		started := false
-		for datum := range mergeVCD(earliest, tScale, details) {
-			if !started || datum.stamp != stamp {
-				stamp = datum.stamp
-				ch <- fmt.Sprint("#", stamp)
-				if !started {
-					ch <- "$dumpvars"
-					started = true
-				}
+	emit("$enddefinitions $end")
+}
+
+// writeVCDDump emits the #<stamp>/value-change stream for details. A
+// #<stamp> line is only written when at least one value change
+// follows it. When dumpvars is true, a bare $dumpvars keyword is
+// written after the first #<stamp> line, ahead of the initial values;
+// no closing $end is written for it. No stamp is ever emitted below floor, so callers
+// writing a dump in successive chunks (VCDEncoder) can keep the
+// overall stream monotonic even when one chunk's source data lags
+// behind another's; the returned value is the highest stamp emitted
+// (or floor, if nothing was emitted), for use as the next floor.
+func writeVCDDump(emit func(string), tScale time.Duration, earliest time.Time, details []*VCDDetail, dumpvars bool, floor uint) uint {
+	stamp := floor
+	started := false
+	for datum := range mergeVCD(earliest, tScale, details) {
+		s := datum.stamp
+		if s < floor {
+			s = floor
+		}
+		if !started || s != stamp {
+			stamp = s
+			emit(fmt.Sprint("#", stamp))
+			if !started && dumpvars {
+				emit("$dumpvars")
 			}
-			ch <- datum.line
+			started = true
 		}
+		emit(datum.line)
+	}
+	return stamp
+}
+
+// ExportVCD generates a single VCD dump file from a set of concurrent
+// trace recordings. The argument dumper names the collection of
+// traces and tScale indicates what a count of 1 means in the counter
+// output.
+func ExportVCD(dumper string, tScale time.Duration, traces ...*Trace) (<-chan string, error) {
+	details, earliest, err := buildVCDDetails(traces)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+		emit := func(s string) { ch <- s }
+		writeVCDHeader(emit, dumper, tScale, earliest, details)
+		writeVCDDump(emit, tScale, earliest, details, true, 0)
 	}()
 	return ch, nil
 }
 
+// WriteVCD streams a VCD dump for traces directly into w through a
+// bufio.Writer, rather than collecting the whole dump into memory as
+// Trace.VCD does. This is the right choice for long-running captures
+// with many transitions, and composes naturally with e.g. a
+// gzip.Writer sink.
+func WriteVCD(w io.Writer, dumper string, tScale time.Duration, traces ...*Trace) error {
+	details, earliest, err := buildVCDDetails(traces)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	emit := func(s string) { fmt.Fprintln(bw, s) }
+	writeVCDHeader(emit, dumper, tScale, earliest, details)
+	writeVCDDump(emit, tScale, earliest, details, true, 0)
+	return bw.Flush()
+}
+
+// ErrVCDEncoderStarted is returned by AddTrace once the encoder has
+// already written its VCD header, since VCD var declarations cannot
+// change mid-dump.
+var ErrVCDEncoderStarted = errors.New("VCD encoder already started: add all traces before the first Flush")
+
+// VCDEncoder streams a VCD dump incrementally, so a long trace can be
+// written out in chunks, interleaved with ongoing sampling, instead
+// of being held in memory until the capture is finished.
+type VCDEncoder struct {
+	mu       sync.Mutex
+	out      io.Writer
+	w        *bufio.Writer
+	dumper   string
+	tScale   time.Duration
+	traces   []*Trace
+	started  bool
+	dumped   bool
+	maxStamp uint
+
+	earliest time.Time
+	details  []*VCDDetail
+	since    []time.Time
+}
+
+// NewVCDEncoder creates an incremental VCD encoder writing to w,
+// using tScale to convert sample times into VCD tick counts.
+func NewVCDEncoder(w io.Writer, tScale time.Duration) *VCDEncoder {
+	return &VCDEncoder{
+		out:    w,
+		w:      bufio.NewWriter(w),
+		dumper: "iotracer",
+		tScale: tScale,
+	}
+}
+
+// AddTrace registers a trace to be included in the dump. Traces must
+// all be added before the first call to Flush, since the VCD header
+// is fixed as soon as it is written.
+func (e *VCDEncoder) AddTrace(t *Trace) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.started {
+		return ErrVCDEncoderStarted
+	}
+	e.traces = append(e.traces, t)
+	return nil
+}
+
+// Flush writes the header, on the first call, then any samples
+// recorded since the previous Flush, and flushes the underlying
+// writer. It is a no-op beyond the header if no trace has produced a
+// new sample.
+func (e *VCDEncoder) Flush() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.started {
+		details, earliest, err := buildVCDDetails(e.traces)
+		if err != nil {
+			return err
+		}
+		e.details = details
+		e.earliest = earliest
+		e.since = make([]time.Time, len(details))
+		writeVCDHeader(func(s string) { fmt.Fprintln(e.w, s) }, e.dumper, e.tScale, earliest, details)
+		e.started = true
+	}
+
+	var chunks []*VCDDetail
+	for i, d := range e.details {
+		fresh := d.owner.snapshotSince(e.since[i])
+		if len(fresh) == 0 {
+			continue
+		}
+		e.since[i] = fresh[len(fresh)-1].When
+		chunks = append(chunks, &VCDDetail{
+			app:      d.app,
+			module:   d.module,
+			fullMask: d.fullMask,
+			samples:  uint(len(fresh)),
+			working:  fresh,
+			sigs:     d.sigs,
+		})
+	}
+	if len(chunks) > 0 {
+		// Different traces advance through Flush at different rates,
+		// so a chunk built from one trace's fresh samples can carry
+		// earlier stamps than another trace's chunk already written
+		// in a prior Flush. Floor every stamp at the highest one
+		// emitted so far so the overall stream stays non-decreasing,
+		// as VCD readers like GTKWave/fst2vcd require.
+		e.maxStamp = writeVCDDump(func(s string) { fmt.Fprintln(e.w, s) }, e.tScale, e.earliest, chunks, !e.dumped, e.maxStamp)
+		e.dumped = true
+	}
+	return e.w.Flush()
+}
+
+// Close flushes any remaining samples and the underlying writer, then
+// closes the sink passed to NewVCDEncoder if it implements io.Closer.
+func (e *VCDEncoder) Close() error {
+	if err := e.Flush(); err != nil {
+		return err
+	}
+	if c, ok := e.out.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
 // VCD generates a Value Change Dump from the trace recorded so far.
 // The function starts by making a snapshot of the current trace.
 func (t *Trace) VCD(tScale time.Duration) (io.Reader, error) {
@@ -0,0 +1,169 @@
+// Package iotracerhttp exposes a package of *iotracer.Trace values
+// over HTTP, patterned after net/http/pprof, so an embedded or
+// headless device can be inspected from an ordinary browser instead
+// of requiring a custom exporter for every firmware.
+package iotracerhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"zappem.net/pub/io/iotracer"
+)
+
+// Handler returns an http.Handler serving an index page, a VCD
+// download, a live signal watch (via Server-Sent Events) and a JSON
+// snapshot of the current circular buffer, for the given traces.
+//
+//	GET /iotracer/                        index of registered traces
+//	GET /iotracer/vcd?app=...&tscale=...  a streamed VCD dump
+//	GET /iotracer/watch?app=...&sig=...   an SSE stream of {when,on}
+//	GET /iotracer/snapshot.json?app=...   the current circular buffer
+func Handler(traces ...*iotracer.Trace) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/iotracer/", func(w http.ResponseWriter, r *http.Request) {
+		indexHandler(w, r, traces)
+	})
+	mux.HandleFunc("/iotracer/vcd", func(w http.ResponseWriter, r *http.Request) {
+		vcdHandler(w, r, traces)
+	})
+	mux.HandleFunc("/iotracer/watch", func(w http.ResponseWriter, r *http.Request) {
+		watchHandler(w, r, traces)
+	})
+	mux.HandleFunc("/iotracer/snapshot.json", func(w http.ResponseWriter, r *http.Request) {
+		snapshotHandler(w, r, traces)
+	})
+	return mux
+}
+
+// findTrace locates the trace named by the app query parameter. If
+// app is empty and exactly one trace is registered, that trace is
+// returned.
+func findTrace(traces []*iotracer.Trace, app string) *iotracer.Trace {
+	if app == "" && len(traces) == 1 {
+		return traces[0]
+	}
+	for _, t := range traces {
+		if t.App() == app {
+			return t
+		}
+	}
+	return nil
+}
+
+func indexHandler(w http.ResponseWriter, r *http.Request, traces []*iotracer.Trace) {
+	if r.URL.Path != "/iotracer/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, "<html><body><h1>iotracer</h1>")
+	fmt.Fprintln(w, "<table border=\"1\"><tr><th>app</th><th>module</th><th>#signals</th><th>labels</th></tr>")
+	for _, t := range traces {
+		sigs := t.Signals()
+		labels := make([]string, len(sigs))
+		for i, s := range sigs {
+			labels[i] = fmt.Sprintf("%d=%s", s.Index, html.EscapeString(s.Label))
+		}
+		app := html.EscapeString(t.App())
+		fmt.Fprintf(w, "<tr><td><a href=\"vcd?app=%[1]s\">%[1]s</a></td><td>%s</td><td>%d</td><td>%s</td></tr>\n",
+			app, html.EscapeString(t.ModuleName()), len(sigs), strings.Join(labels, ", "))
+	}
+	fmt.Fprintln(w, "</table></body></html>")
+}
+
+func vcdHandler(w http.ResponseWriter, r *http.Request, traces []*iotracer.Trace) {
+	tScale := time.Nanosecond
+	if v := r.URL.Query().Get("tscale"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad tscale: %v", err), http.StatusBadRequest)
+			return
+		}
+		tScale = d
+	}
+
+	sel := traces
+	if app := r.URL.Query().Get("app"); app != "" {
+		t := findTrace(traces, app)
+		if t == nil {
+			http.NotFound(w, r)
+			return
+		}
+		sel = []*iotracer.Trace{t}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=trace.vcd")
+	if err := iotracer.WriteVCD(w, "iotracerhttp", tScale, sel...); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// watchEvent is the JSON payload pushed for each signal change.
+type watchEvent struct {
+	When time.Time `json:"when"`
+	On   bool      `json:"on"`
+}
+
+func watchHandler(w http.ResponseWriter, r *http.Request, traces []*iotracer.Trace) {
+	t := findTrace(traces, r.URL.Query().Get("app"))
+	if t == nil {
+		http.NotFound(w, r)
+		return
+	}
+	sig, err := strconv.Atoi(r.URL.Query().Get("sig"))
+	if err != nil {
+		http.Error(w, "missing or invalid sig", http.StatusBadRequest)
+		return
+	}
+	ch, err := t.Watch(sig, 16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer t.Cancel(ch)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(watchEvent{When: ev.When, On: ev.On})
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func snapshotHandler(w http.ResponseWriter, r *http.Request, traces []*iotracer.Trace) {
+	t := findTrace(traces, r.URL.Query().Get("app"))
+	if t == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(t.Snapshot()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}